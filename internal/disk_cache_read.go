@@ -0,0 +1,67 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import "github.com/mattrbianchi/twig"
+
+// readFileThroughCache services a read against fs.cache when the request
+// falls entirely within one cache block, consulting the cache before
+// falling back to fh.ReadFile and writing the fetched block back for next
+// time. Returns ok=false (with the caller expected to fall back to
+// fh.ReadFile directly) whenever the cache isn't configured or the
+// requested range crosses a block boundary — re-fetching a block is cheap
+// enough that it's not worth the bookkeeping to stitch two cached blocks
+// together for what the kernel normally asks for in one call anyway.
+func (fs *Fusera) readFileThroughCache(fh *FileHandle, offset int64, dst []byte) (n int, ok bool, err error) {
+	if fs.cache == nil || len(dst) == 0 {
+		return 0, false, nil
+	}
+
+	blockSize := fs.cache.BlockSize()
+	blockIdx := fs.cache.BlockIndex(offset)
+	blockStart := blockIdx * blockSize
+
+	if offset+int64(len(dst)) > blockStart+blockSize {
+		return 0, false, nil
+	}
+
+	link := fh.inode.Link
+
+	if data, hit, cerr := fs.cache.Get(link, blockIdx); cerr == nil && hit {
+		n = copy(dst, data[offset-blockStart:])
+		return n, true, nil
+	}
+
+	block := make([]byte, blockSize)
+	read, err := fh.ReadFile(blockStart, block)
+	if err != nil {
+		return 0, false, err
+	}
+	block = block[:read]
+
+	if err := fs.cache.Put(link, blockIdx, block); err != nil {
+		// a cache write failure shouldn't fail the read; the data we just
+		// fetched is still good, just not persisted for next time.
+		twig.Debugf("diskcache: failed to store block %v of %v: %v", blockIdx, link, err)
+	}
+
+	if int(offset-blockStart) >= len(block) {
+		return 0, true, nil
+	}
+
+	n = copy(dst, block[offset-blockStart:])
+	return n, true, nil
+}
@@ -0,0 +1,426 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diskcache is a bounded, on-disk LRU of fixed-size blocks fetched
+// from HTTP-backed file inodes. It is consulted before FileHandle.ReadFile
+// goes to the network: a hit avoids re-issuing a Range GET against a signed URL that
+// may be expensive, rate-limited, or simply slow to reach again across
+// separate mounts of the same SRA/dbGaP accession.
+package diskcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBlockSize is used when Config.BlockSize is left at zero.
+const DefaultBlockSize = 4 * 1024 * 1024
+
+// DefaultCacheSizeGB is used when Config.SizeGB is left at zero, so
+// enabling the cache with just --cache-dir still bounds it instead of
+// growing without limit.
+const DefaultCacheSizeGB = 10
+
+// journalName is the file within Dir that records LRU order so the cache
+// survives restarts without doing a full directory walk to rebuild it.
+const journalName = ".journal"
+
+// Config controls how a Cache is opened.
+type Config struct {
+	// Dir is the cache's root directory. Created if it doesn't exist.
+	Dir string
+
+	// BlockSize is the fixed block size files are chunked into.
+	// Defaults to DefaultBlockSize.
+	BlockSize int64
+
+	// SizeGB bounds the cache's total on-disk size. Once exceeded, the
+	// least-recently-used blocks are evicted to make room.
+	SizeGB float64
+}
+
+// blockKey identifies one cached block of one remote file.
+type blockKey struct {
+	Link     string `json:"link"`
+	BlockIdx int64  `json:"block"`
+}
+
+func (k blockKey) dir(root string) string {
+	sum := sha256.Sum256([]byte(k.Link))
+	return filepath.Join(root, hex.EncodeToString(sum[:]))
+}
+
+func (k blockKey) path(root string) string {
+	return filepath.Join(k.dir(root), fmt.Sprintf("%d", k.BlockIdx))
+}
+
+// compactEvery bounds how many appended journal records a Cache tolerates
+// before it compacts back down to one record per live entry. Without this
+// a long-running mount would grow its journal forever even though the set
+// of live blocks stays roughly constant.
+const compactEvery = 4096
+
+// Cache is a bounded-size, on-disk LRU block cache keyed by (link,
+// blockIdx). It's safe for concurrent use.
+type Cache struct {
+	mu sync.Mutex
+
+	root      string
+	blockSize int64
+	maxBytes  int64
+
+	// order tracks LRU order, front is most-recently-used. entries maps a
+	// blockKey to its position in order so Get/Put are O(1).
+	//
+	// GUARDED_BY(mu)
+	order   *list.List
+	entries map[blockKey]*list.Element
+
+	curBytes int64
+
+	// journal is opened in append mode; Put/evictLocked append one record
+	// per change instead of rewriting the whole file, so a write's cost
+	// doesn't grow with how many blocks are already cached.
+	//
+	// GUARDED_BY(mu)
+	journal *os.File
+
+	// appended counts records written to journal since the last
+	// compaction, to decide when it's worth paying for one.
+	//
+	// GUARDED_BY(mu)
+	appended int
+}
+
+// entry is the payload stored in Cache.order.
+type entry struct {
+	key  blockKey
+	size int64
+}
+
+// Open creates cfg.Dir if necessary, replays its journal to rebuild LRU
+// order, and returns a ready-to-use Cache.
+func Open(cfg Config) (*Cache, error) {
+	blockSize := cfg.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	sizeGB := cfg.SizeGB
+	if sizeGB <= 0 {
+		sizeGB = DefaultCacheSizeGB
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "diskcache: creating cache dir")
+	}
+
+	c := &Cache{
+		root:      cfg.Dir,
+		blockSize: blockSize,
+		maxBytes:  int64(sizeGB * 1024 * 1024 * 1024),
+		order:     list.New(),
+		entries:   make(map[blockKey]*list.Element),
+	}
+
+	if err := c.loadJournal(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(c.root, journalName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "diskcache: opening journal for append")
+	}
+	c.journal = f
+
+	return c, nil
+}
+
+// BlockSize returns the configured block size.
+func (c *Cache) BlockSize() int64 {
+	return c.blockSize
+}
+
+// BlockIndex returns the block index that offset falls into.
+func (c *Cache) BlockIndex(offset int64) int64 {
+	return offset / c.blockSize
+}
+
+// Get returns the cached bytes for (link, blockIdx), or ok=false on a
+// cache miss.
+func (c *Cache) Get(link string, blockIdx int64) (data []byte, ok bool, err error) {
+	key := blockKey{Link: link, BlockIdx: blockIdx}
+
+	c.mu.Lock()
+	el, found := c.entries[key]
+	if found {
+		c.order.MoveToFront(el)
+	}
+	c.mu.Unlock()
+
+	if !found {
+		return nil, false, nil
+	}
+
+	data, err = ioutil.ReadFile(key.path(c.root))
+	if os.IsNotExist(err) {
+		// journal said it was there but the file's gone (e.g. the cache
+		// dir was partially cleared out-of-band); treat it as a miss. The
+		// remove record is best-effort: even if it's lost, the next
+		// compaction rewrites the journal from c.entries, which no
+		// longer has this key, so it self-heals either way.
+		c.mu.Lock()
+		c.removeLocked(key)
+		c.appendJournalLocked(journalRecord{Kind: journalRemove, Key: key})
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+// Put writes data as block blockIdx of link, atomically (write to a temp
+// file, then rename), and evicts LRU blocks as needed to stay under the
+// configured size bound.
+func (c *Cache) Put(link string, blockIdx int64, data []byte) error {
+	key := blockKey{Link: link, BlockIdx: blockIdx}
+
+	if err := os.MkdirAll(key.dir(c.root), 0755); err != nil {
+		return errors.Wrap(err, "diskcache: creating block dir")
+	}
+
+	tmp, err := ioutil.TempFile(key.dir(c.root), ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "diskcache: creating temp file")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "diskcache: writing block")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "diskcache: closing temp file")
+	}
+	if err := os.Rename(tmp.Name(), key.path(c.root)); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "diskcache: renaming block into place")
+	}
+
+	c.mu.Lock()
+	c.insertLocked(key, int64(len(data)))
+	if err = c.appendJournalLocked(journalRecord{Kind: journalPut, Key: key, Size: int64(len(data))}); err == nil {
+		c.evictLocked()
+		if c.appended > compactEvery {
+			err = c.compactLocked()
+		}
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+// CachedBytes returns the number of bytes of link that are currently
+// resident in the cache, summed across whichever blocks happen to be
+// present. Used to populate the user.fusera.cached_bytes xattr.
+func (c *Cache) CachedBytes(link string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var total int64
+	for key, el := range c.entries {
+		if key.Link == link {
+			total += el.Value.(*entry).size
+		}
+	}
+	return total
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) insertLocked(key blockKey, size int64) {
+	if el, ok := c.entries[key]; ok {
+		c.curBytes -= el.Value.(*entry).size
+		c.order.MoveToFront(el)
+		el.Value.(*entry).size = size
+	} else {
+		el := c.order.PushFront(&entry{key: key, size: size})
+		c.entries[key] = el
+	}
+	c.curBytes += size
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) removeLocked(key blockKey) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.curBytes -= el.Value.(*entry).size
+	c.order.Remove(el)
+	delete(c.entries, key)
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) evictLocked() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	for c.curBytes > c.maxBytes {
+		back := c.order.Back()
+		if back == nil {
+			break
+		}
+		e := back.Value.(*entry)
+		os.Remove(e.key.path(c.root))
+		c.removeLocked(e.key)
+		// best-effort, same reasoning as the Get-path remove above.
+		c.appendJournalLocked(journalRecord{Kind: journalRemove, Key: e.key})
+	}
+}
+
+// journalKind distinguishes a block being cached from one being evicted,
+// so replaying the journal end to end reconstructs the live set without
+// needing a full rewrite on every change.
+type journalKind string
+
+const (
+	journalPut    journalKind = "put"
+	journalRemove journalKind = "remove"
+)
+
+// journalRecord is one line of the on-disk journal.
+type journalRecord struct {
+	Kind journalKind `json:"kind"`
+	Key  blockKey    `json:"key"`
+	Size int64       `json:"size,omitempty"`
+}
+
+// appendJournalLocked appends one record to the open journal file. Put and
+// eviction call this instead of rewriting the whole journal, so a write's
+// cost doesn't grow with how many blocks are already cached.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) appendJournalLocked(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "diskcache: encoding journal record")
+	}
+	line = append(line, '\n')
+
+	if _, err := c.journal.Write(line); err != nil {
+		return errors.Wrap(err, "diskcache: appending to journal")
+	}
+	c.appended++
+	return nil
+}
+
+// compactLocked rewrites the journal from scratch with exactly one "put"
+// record per currently-live entry, atomically (temp file + rename), then
+// reopens it for append. Called periodically from Put once the append-only
+// journal has accumulated enough stale records to be worth reclaiming;
+// unlike the per-write path this one call is O(live entries).
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Cache) compactLocked() error {
+	f, err := ioutil.TempFile(c.root, ".journal-")
+	if err != nil {
+		return errors.Wrap(err, "diskcache: compacting journal")
+	}
+
+	enc := json.NewEncoder(f)
+	// oldest first, so a truncated journal on a crash still replays a
+	// usable (if smaller) LRU rather than garbage order.
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if err := enc.Encode(journalRecord{Kind: journalPut, Key: e.key, Size: e.size}); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return errors.Wrap(err, "diskcache: encoding journal record")
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "diskcache: closing journal")
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.root, journalName)); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "diskcache: renaming journal into place")
+	}
+
+	if err := c.journal.Close(); err != nil {
+		return errors.Wrap(err, "diskcache: closing old journal handle")
+	}
+	newJournal, err := os.OpenFile(filepath.Join(c.root, journalName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "diskcache: reopening journal for append")
+	}
+	c.journal = newJournal
+	c.appended = 0
+
+	return nil
+}
+
+// loadJournal replays the on-disk journal, applying "put" records in order
+// and removing any key a later "remove" record drops, so Open rebuilds
+// the same LRU order and live set the cache had before restarting.
+func (c *Cache) loadJournal() error {
+	f, err := os.Open(filepath.Join(c.root, journalName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "diskcache: opening journal")
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var rec journalRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			// a partially-written journal from a crash is recoverable by
+			// just stopping at the first bad record; what we've loaded
+			// so far is still a valid (if incomplete) LRU.
+			break
+		}
+
+		switch rec.Kind {
+		case journalRemove:
+			c.removeLocked(rec.Key)
+		default: // journalPut, and the empty Kind from before it existed
+			if _, err := os.Stat(rec.Key.path(c.root)); err != nil {
+				continue
+			}
+			c.insertLocked(rec.Key, rec.Size)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import "time"
+
+// FlagStorage holds every mount-time option, populated by the CLI entry
+// point before NewFusera is called.
+type FlagStorage struct {
+	MountPoint string
+
+	DebugFuse bool
+	DebugS3   bool
+
+	Loc string
+	Ngc string
+	Acc []string
+
+	// Uid/Gid are reported as the owner of every inode in the mount;
+	// fusera is a single-owner filesystem, so these come from the
+	// mounting process rather than per-request identity.
+	Uid uint32
+	Gid uint32
+
+	StatCacheTTL time.Duration
+	TypeCacheTTL time.Duration
+
+	// ReadaheadMB/ReadaheadWorkers size the background prefetcher; zero
+	// values fall back to defaultReadaheadMB/defaultReadaheadWorkers.
+	ReadaheadMB      int
+	ReadaheadWorkers int
+
+	// CacheDir, if set, turns on the on-disk block cache for downloaded
+	// file ranges (see internal/diskcache). CacheSizeGB bounds its total
+	// size; diskcache.Open applies its own default if this is zero.
+	CacheDir    string
+	CacheSizeGB float64
+
+	// AuditLog turns on the per-request audit log (see auditf). It only
+	// ever logs pid, not uid/gid - see RequestContext's doc comment.
+	AuditLog bool
+
+	// RestrictLocalAccess would gate file reads to the mount owner, but
+	// NewFusera refuses to start when it's set: there's no caller uid to
+	// check it against (see checkPermission). Kept here, rather than
+	// deleted, so the CLI flag parses and the error at mount time is the
+	// one place this gets explained.
+	RestrictLocalAccess bool
+}
@@ -0,0 +1,36 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Init handles the FUSE_INIT handshake. As with ReadDirPlus, implementing
+// this method is itself what gets it called: jacobsa/fuse dispatches
+// FUSE_INIT to it when a mounted fuseutil.FileSystem implements Init,
+// rather than requiring Mount to know the negotiated values up front. That
+// lets NewFusera build Readahead before the kernel connection exists (with
+// max_readahead unknown) and have the real value filled in here once
+// FUSE_INIT completes.
+func (fs *Fusera) Init(ctx context.Context, op *fuseops.InitOp) error {
+	if fs.readahead != nil {
+		fs.readahead.SetMaxReadahead(op.MaxReadahead)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/mattrbianchi/twig"
+	"github.com/mitre/fusera/nr"
+	"github.com/pkg/errors"
+)
+
+// refreshInterval is how often the background refresher re-resolves names
+// and invalidates entries whose signed URL has rotated.
+const refreshInterval = 5 * time.Minute
+
+// InvalidateInode tells the kernel to drop its cached attributes and, for
+// the given byte range, page cache for id. Pass off=0, len=0 to invalidate
+// the whole file. Used after a background refresh learns that an
+// accession's file metadata changed out from under an open mount.
+func (fs *Fusera) InvalidateInode(id fuseops.InodeID, off, len int64) error {
+	fs.mu.Lock()
+	conn := fs.conn
+	fs.mu.Unlock()
+
+	if conn == nil {
+		return errors.New("InvalidateInode: not mounted")
+	}
+	return conn.InvalidateInode(id, off, len)
+}
+
+// InvalidateEntry tells the kernel to drop its cached dentry for name
+// under parent, so the next lookup goes back to Fusera instead of being
+// served from the kernel's dentry cache. Used when a rotated pre-signed
+// URL means the old child inode should no longer be trusted.
+func (fs *Fusera) InvalidateEntry(parent fuseops.InodeID, name string) error {
+	fs.mu.Lock()
+	conn := fs.conn
+	fs.mu.Unlock()
+
+	if conn == nil {
+		return errors.New("InvalidateEntry: not mounted")
+	}
+	return conn.InvalidateEntry(parent, name)
+}
+
+// setConnection records the live fuse.Connection once Mount has it, so
+// InvalidateInode/InvalidateEntry and the refresh loop have somewhere to
+// write their notifications.
+func (fs *Fusera) setConnection(mfs *fuse.MountedFileSystem) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.conn = mfs.Connection
+}
+
+// refreshLoop periodically re-resolves accession names via nr.ResolveNames
+// and invalidates any entry whose Link rotated, so clients pick up
+// refreshed pre-signed URLs and newly added accession files without an
+// unmount/remount. It also refreshes immediately on SIGHUP.
+func (fs *Fusera) refreshLoop() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.refreshAccessions()
+		case <-sighup:
+			twig.Infof("SIGHUP received, forcing accession refresh")
+			fs.refreshAccessions()
+		}
+	}
+}
+
+// refreshAccessions re-resolves flags.Loc/flags.Acc and brings the inode
+// tree up to date with the result: newly-appeared accessions and files are
+// materialized (and their entry under the parent invalidated, so a kernel dentry
+// cache that remembers the name as missing stops serving that negative
+// lookup), and any file whose signed URL rotated gets its entry
+// invalidated too.
+func (fs *Fusera) refreshAccessions() {
+	payload, err := nr.ResolveNames(fs.flags.Loc, fs.flags.Ngc, fs.flags.Acc)
+	if err != nil {
+		twig.Debugf("refreshAccessions: ResolveNames failed: %v", err)
+		return
+	}
+
+	fs.mu.Lock()
+	root := fs.inodes[fuseops.RootInodeID]
+	fs.mu.Unlock()
+
+	for i := range payload {
+		root.mu.Lock()
+		dir := root.findChildUnlocked(payload[i].ID, true)
+		isNewDir := dir == nil
+		if isNewDir {
+			fullDirName := root.getChildName(payload[i].ID)
+			dir = NewInode(fs, root, &payload[i].ID, &fullDirName)
+			dir.ToDir()
+			dir.touch()
+
+			fs.mu.Lock()
+			fs.insertInode(root, dir)
+			fs.mu.Unlock()
+		}
+		root.mu.Unlock()
+
+		if isNewDir {
+			if err := fs.InvalidateEntry(root.Id, payload[i].ID); err != nil {
+				twig.Debugf("refreshAccessions: InvalidateEntry(%v) failed: %v", payload[i].ID, err)
+			}
+		}
+
+		for j := range payload[i].Files {
+			dir.mu.Lock()
+			file := dir.findChildUnlocked(payload[i].Files[j].Name, false)
+			isNewFile := file == nil
+			if isNewFile {
+				fullFileName := dir.getChildName(payload[i].Files[j].Name)
+				file = NewInode(fs, dir, &payload[i].Files[j].Name, &fullFileName)
+				file.Link = payload[i].Files[j].Link
+				if size, serr := strconv.ParseUint(payload[i].Files[j].Size, 10, 64); serr == nil {
+					file.Attributes = InodeAttributes{
+						Size:  size,
+						Mtime: time.Now(),
+					}
+				}
+				dir.touch()
+
+				fs.mu.Lock()
+				fs.insertInode(dir, file)
+				fs.mu.Unlock()
+			}
+			dir.mu.Unlock()
+
+			var rotated bool
+			if !isNewFile {
+				file.mu.Lock()
+				rotated = file.Link != payload[i].Files[j].Link
+				if rotated {
+					file.Link = payload[i].Files[j].Link
+				}
+				file.mu.Unlock()
+			}
+
+			if isNewFile || rotated {
+				if err := fs.InvalidateEntry(dir.Id, payload[i].Files[j].Name); err != nil {
+					twig.Debugf("refreshAccessions: InvalidateEntry(%v) failed: %v", payload[i].Files[j].Name, err)
+				}
+			}
+		}
+	}
+}
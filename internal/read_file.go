@@ -0,0 +1,124 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/mattrbianchi/twig"
+)
+
+// capVectoredRead gates VectoredReadFile. It is hard-coded false: a real
+// writev(2) reply requires the vendored github.com/jacobsa/fuse library to
+// expose a scatter-gather reply path and a FUSE_INIT capability
+// negotiation hook, and fuseutil.FileSystem gives implementers no such
+// hook today. Flipping this on without that upstream change would just
+// relabel the ordinary copy path as "vectored" while claiming a throughput
+// win it doesn't deliver, so until jacobsa/fuse grows that capability this
+// stays off and ReadFile always takes the classic path below.
+const capVectoredRead = false
+
+// VectoredReadFile is the read path that would hand back the pooled MBuf
+// chunks backing a file handle's buffer directly, rather than a single
+// copy into a caller-supplied []byte, once the kernel connection can reply
+// with a real writev(2). See capVectoredRead for why it's disabled.
+func (fs *Fusera) VectoredReadFile(ctx context.Context, op *fuseops.ReadFileOp) (bufs [][]byte, ok bool, err error) {
+	if !capVectoredRead {
+		return nil, false, nil
+	}
+
+	fs.mu.Lock()
+	fh := fs.fileHandles[op.Handle]
+	fs.mu.Unlock()
+
+	if fh == nil {
+		return nil, false, nil
+	}
+
+	bufs, err = fh.ReadFileVectored(op.Offset, len(op.Dst))
+	if err != nil || bufs == nil {
+		return nil, false, err
+	}
+
+	return bufs, true, nil
+}
+
+// assembleVectoredRead copies each fragment in bufs into dst back to back
+// and returns the total bytes copied. Split out from ReadFile so it can be
+// tested without the rest of the FileHandle/MBuf machinery.
+func assembleVectoredRead(dst []byte, bufs [][]byte) int {
+	n := 0
+	for _, b := range bufs {
+		n += copy(dst[n:], b)
+	}
+	return n
+}
+
+// ReadFile services a read, in order, from: the vectored fast path (see
+// capVectoredRead), the readahead prefetcher, the on-disk block cache,
+// and finally a synchronous fetch through fh.ReadFile. Only the first of
+// these that has an answer for the request is used, so a handle with a
+// readahead hit never also takes a network round trip, and a hit served
+// from readahead or cache still feeds Schedule so the prefetcher keeps
+// pace with a sequential reader.
+func (fs *Fusera) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
+	ctx = fs.withRequestContext(ctx, fs.requestContext(ctx))
+	if err = fs.checkPermission(ctx); err != nil {
+		return
+	}
+
+	if bufs, ok, verr := fs.VectoredReadFile(ctx, op); verr == nil && ok {
+		op.BytesRead = assembleVectoredRead(op.Dst, bufs)
+		return nil
+	}
+
+	fs.mu.Lock()
+	fh := fs.fileHandles[op.Handle]
+	fs.mu.Unlock()
+
+	if fs.readahead != nil {
+		if buf, rel, ok, raErr := fs.readahead.Take(op.Handle, op.Offset); ok {
+			if raErr != nil {
+				// The prefetch itself failed (network blip, expired
+				// signed URL on the background GET); that's no reason
+				// to fail this foreground read when a synchronous fetch
+				// below would likely succeed, so just fall through.
+				twig.Debugf("readahead: prefetch for handle %v failed, falling back to synchronous read: %v", op.Handle, raErr)
+			} else {
+				op.BytesRead = copy(op.Dst, buf.Bytes()[rel:])
+				fs.readahead.Schedule(fh, op.Handle, op.Offset, op.BytesRead)
+				return nil
+			}
+		}
+	}
+
+	if n, ok, cerr := fs.readFileThroughCache(fh, op.Offset, op.Dst); ok {
+		op.BytesRead, err = n, cerr
+		if err == nil && fs.readahead != nil {
+			fs.readahead.Schedule(fh, op.Handle, op.Offset, op.BytesRead)
+		}
+		return
+	}
+
+	op.BytesRead, err = fh.ReadFile(op.Offset, op.Dst)
+
+	if err == nil && fs.readahead != nil {
+		fs.readahead.Schedule(fh, op.Handle, op.Offset, op.BytesRead)
+	}
+
+	return
+}
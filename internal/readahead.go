@@ -0,0 +1,334 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/mattrbianchi/twig"
+)
+
+// defaultReadaheadMB and defaultReadaheadWorkers are used when
+// FlagStorage.ReadaheadMB / ReadaheadWorkers are left at zero.
+const (
+	defaultReadaheadMB      = 16
+	defaultReadaheadWorkers = 4
+
+	// readaheadWatermark is how far into the current prefetched chunk a
+	// read has to land before Schedule fetches the next one. Triggering
+	// well before the chunk is exhausted is what hides the fetch latency
+	// behind the reads still being served from the current chunk.
+	readaheadWatermark = 0.5
+)
+
+// rangeKey identifies one prefetched range.
+type rangeKey struct {
+	handle fuseops.HandleID
+	offset int64
+}
+
+// readaheadEntry tracks one in-flight or completed prefetch. done is closed
+// once buf (or err) is populated, so a real read racing a prefetch that's
+// still running can just wait on it instead of issuing a second GET.
+type readaheadEntry struct {
+	fh   *FileHandle
+	key  rangeKey
+	size int
+	buf  *MBuf
+	err  error
+	done chan struct{}
+}
+
+// handleState is the sequential-access tracking for one open file handle.
+// Fusera only ever keeps at most one prefetched range in flight per
+// handle: a single chunk ahead is enough to hide a Range GET's latency
+// behind the reads the caller is already making, and it keeps memory use
+// bounded by the number of open handles rather than by how many reads a
+// handle has made.
+//
+// GUARDED_BY(Readahead.mu)
+type handleState struct {
+	// lastEnd is the end offset (offset+n) of the most recent read seen
+	// for this handle. A new read only counts as "sequential" - and so
+	// worth prefetching ahead of - when its offset matches lastEnd.
+	lastEnd int64
+
+	// pending is the one outstanding or completed prefetch for this
+	// handle, or nil if nothing has been scheduled yet.
+	pending *readaheadEntry
+}
+
+// Readahead is a small worker pool that watches ReadFile traffic for
+// sequential access and, when it sees it, speculatively fetches the next
+// chunk of a file's HTTP range into a pooled MBuf ahead of the caller
+// asking for them. The kernel's own ra_pages readahead is capped by
+// MaxReadahead, which for remote object-store backends is far short of
+// what a single HTTP round-trip can amortize, so this duplicates a bounded
+// amount of that logic in user space.
+type Readahead struct {
+	mu sync.Mutex
+
+	chunkSize int64
+	maxBytes  int64 // negotiated max_readahead from the kernel init message
+
+	// GUARDED_BY(mu)
+	states map[fuseops.HandleID]*handleState
+
+	jobs chan *readaheadEntry
+
+	// fetch performs the actual HTTP Range GET for (fh, offset, size) and
+	// returns a pooled buffer. Set by NewReadahead; broken out as a field
+	// so Readahead can be exercised without the HTTP stack.
+	fetch func(fh *FileHandle, offset int64, size int) (*MBuf, error)
+
+	closed bool
+}
+
+// NewReadahead starts a Readahead pool sized from flags, defaulting
+// ReadaheadMB/ReadaheadWorkers to sane values when unset. maxReadahead
+// clamps each prefetch to the kernel's max_readahead; 0 means no clamp,
+// which is what NewFusera passes before FUSE_INIT (see SetMaxReadahead).
+func NewReadahead(flags *FlagStorage, maxReadahead uint32, fetch func(fh *FileHandle, offset int64, size int) (*MBuf, error)) *Readahead {
+	mb := flags.ReadaheadMB
+	if mb <= 0 {
+		mb = defaultReadaheadMB
+	}
+	workers := flags.ReadaheadWorkers
+	if workers <= 0 {
+		workers = defaultReadaheadWorkers
+	}
+
+	ra := &Readahead{
+		chunkSize: int64(mb) * 1024 * 1024,
+		maxBytes:  int64(maxReadahead),
+		states:    make(map[fuseops.HandleID]*handleState),
+		jobs:      make(chan *readaheadEntry, workers*4),
+		fetch:     fetch,
+	}
+
+	for i := 0; i < workers; i++ {
+		go ra.worker()
+	}
+
+	return ra
+}
+
+func (ra *Readahead) worker() {
+	for entry := range ra.jobs {
+		buf, err := ra.fetch(entry.fh, entry.key.offset, entry.size)
+
+		ra.mu.Lock()
+		entry.buf, entry.err = buf, err
+		ra.mu.Unlock()
+
+		close(entry.done)
+	}
+}
+
+// Schedule records that [offset, offset+n) was just read on handle and, if
+// that read continued on from the previous one (i.e. is actually
+// sequential rather than random access), makes sure a prefetch for the
+// following chunk is in flight. It never blocks the caller; a full job
+// queue just drops the hint.
+//
+// LOCKS_EXCLUDED(ra.mu)
+func (ra *Readahead) Schedule(fh *FileHandle, handle fuseops.HandleID, offset int64, n int) {
+	end := offset + int64(n)
+
+	ra.mu.Lock()
+	if ra.closed {
+		ra.mu.Unlock()
+		return
+	}
+
+	st, ok := ra.states[handle]
+	if !ok {
+		st = &handleState{}
+		ra.states[handle] = st
+	}
+
+	sequential := st.lastEnd != 0 && offset == st.lastEnd
+	st.lastEnd = end
+
+	if !sequential {
+		ra.mu.Unlock()
+		return
+	}
+
+	if st.pending != nil {
+		// only start the next fetch once the caller has read far enough
+		// into the current one that it's about to run out, so a steady
+		// stream of small reads amortizes over one fetch per chunk
+		// instead of issuing a new Range GET on every call.
+		consumed := end - st.pending.key.offset
+		if consumed < int64(float64(st.pending.size)*readaheadWatermark) {
+			ra.mu.Unlock()
+			return
+		}
+	}
+
+	size := ra.chunkSize
+	if ra.maxBytes > 0 && size > ra.maxBytes {
+		size = ra.maxBytes
+	}
+
+	entry := &readaheadEntry{fh: fh, key: rangeKey{handle: handle, offset: end}, size: int(size), done: make(chan struct{})}
+	st.pending = entry
+	ra.mu.Unlock()
+
+	select {
+	case ra.jobs <- entry:
+	default:
+		// queue is saturated; drop the hint rather than block ReadFile.
+		ra.mu.Lock()
+		if st.pending == entry {
+			st.pending = nil
+		}
+		ra.mu.Unlock()
+	}
+}
+
+// Take returns prefetched bytes covering offset on handle, if the
+// in-flight or completed prefetch for that handle covers it, blocking
+// until it resolves. ok is false when nothing
+// scheduled for this handle covers offset, in which case the caller
+// should fall back to its own synchronous fetch. Once offset reaches the
+// end of the prefetched chunk, the entry is evicted so a stale, fully
+// consumed buffer doesn't linger.
+func (ra *Readahead) Take(handle fuseops.HandleID, offset int64) (buf *MBuf, rel int64, ok bool, err error) {
+	ra.mu.Lock()
+	st, found := ra.states[handle]
+	if !found || st.pending == nil {
+		ra.mu.Unlock()
+		return nil, 0, false, nil
+	}
+	entry := st.pending
+	start := entry.key.offset
+	size := int64(entry.size)
+	ra.mu.Unlock()
+
+	// size is what was requested, not what the server necessarily sent
+	// back; this is just a cheap pre-wait rejection of offsets nowhere
+	// near the range, the real bound is checked below against the bytes
+	// actually fetched.
+	if offset < start {
+		return nil, 0, false, nil
+	}
+	if offset >= start+size {
+		ra.mu.Lock()
+		if st.pending == entry {
+			st.pending = nil
+		}
+		ra.mu.Unlock()
+		return nil, 0, false, nil
+	}
+
+	<-entry.done
+
+	if entry.err != nil {
+		ra.mu.Lock()
+		if st.pending == entry {
+			st.pending = nil
+		}
+		ra.mu.Unlock()
+		return nil, 0, true, entry.err
+	}
+
+	// The final chunk of a file legitimately comes back shorter than
+	// requested (the Range GET hits EOF), so rel has to be checked
+	// against the bytes actually fetched, not the nominal request size,
+	// or it can index past the end of entry.buf.Bytes().
+	rel = offset - start
+	if rel >= int64(len(entry.buf.Bytes())) {
+		ra.mu.Lock()
+		if st.pending == entry {
+			st.pending = nil
+		}
+		ra.mu.Unlock()
+		return nil, 0, false, nil
+	}
+
+	return entry.buf, rel, true, nil
+}
+
+// SetMaxReadahead records the kernel's negotiated max_readahead, clamping
+// future prefetch fetches to it. Called once the FUSE_INIT reply is known;
+// see Fusera.Init.
+//
+// LOCKS_EXCLUDED(ra.mu)
+func (ra *Readahead) SetMaxReadahead(max uint32) {
+	ra.mu.Lock()
+	ra.maxBytes = int64(max)
+	ra.mu.Unlock()
+}
+
+// Cancel drops the pending prefetch (if any) and forgets sequential-access
+// state for handle. Called from ReleaseFileHandle so a closed file doesn't
+// keep fetching ranges nobody will ever read.
+//
+// LOCKS_EXCLUDED(ra.mu)
+func (ra *Readahead) Cancel(handle fuseops.HandleID) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	delete(ra.states, handle)
+
+	twig.Debugf("readahead: cancelled pending range for handle %v", handle)
+}
+
+// fetchRangeForReadahead issues the speculative HTTP Range GET for
+// [offset, offset+size) against fh's signed URL and copies the response
+// into a pooled MBuf. It's the default fetch func passed to NewReadahead.
+func fetchRangeForReadahead(fh *FileHandle, offset int64, size int) (*MBuf, error) {
+	req, err := http.NewRequest("GET", fh.inode.Link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(size)-1))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("readahead: unexpected status %v fetching %v", resp.StatusCode, fh.inode.Link)
+	}
+
+	buf := MBuf{}.Init(fh.poolHandle, uint64(size), false)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Close stops accepting new prefetch schedules. In-flight fetches are left
+// to run to completion on their worker goroutine; nobody will call Take
+// for them again.
+func (ra *Readahead) Close() {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.closed {
+		return
+	}
+	ra.closed = true
+	close(ra.jobs)
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func makeDirEntryPlus(en *DirHandleEntry, entry fuseops.ChildInodeEntry) fuseutil.DirentPlus {
+	return fuseutil.DirentPlus{
+		Dirent: makeDirEntry(en),
+		Entry:  entry,
+	}
+}
+
+// ReadDirPlus is ReadDir's counterpart for the READDIRPLUS opcode: for every
+// entry it also materializes the child inode and fills in a full
+// ChildInodeEntry, so the kernel can populate its dentry/attr caches without
+// following up with a LOOKUP for each name. On a directory with hundreds of
+// accession files this saves hundreds of round-trips per `ls -l`.
+//
+// Fusera implementing this method is itself the capability advertisement:
+// jacobsa/fuse only sends FUSE_CAP_READDIRPLUS in its FUSE_INIT reply, and
+// only ever dispatches the READDIRPLUS opcode to this method, when a
+// mounted fuseutil.FileSystem implements it. A kernel that doesn't
+// negotiate READDIRPLUS simply keeps issuing plain READDIR, which the
+// library routes to ReadDir as always - there's no separate fallback
+// branch to maintain here.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *Fusera) ReadDirPlus(ctx context.Context, op *fuseops.ReadDirPlusOp) (err error) {
+	fs.mu.Lock()
+	dh := fs.dirHandles[op.Handle]
+	fs.mu.Unlock()
+
+	if dh == nil {
+		panic(fmt.Sprintf("can't find dh=%v", op.Handle))
+	}
+
+	inode := dh.inode
+	inode.logFuse("ReadDirPlus", op.Offset)
+
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	readFromS3 := false
+
+	for i := op.Offset; ; i++ {
+		e, err := dh.ReadDir(i)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			if readFromS3 {
+				inode.dir.DirTime = time.Now()
+				inode.Attributes.Mtime = inode.findChildMaxTime()
+			}
+			break
+		}
+
+		if e.Inode == 0 {
+			readFromS3 = true
+		}
+		child := fs.insertInodeFromDirEntry(inode, e)
+
+		fs.mu.Lock()
+		child.Ref()
+		fs.mu.Unlock()
+
+		entry := fuseops.ChildInodeEntry{
+			Child:                child.Id,
+			Attributes:           child.InflateAttributes(),
+			AttributesExpiration: time.Now().Add(fs.flags.StatCacheTTL),
+			EntryExpiration:      time.Now().Add(fs.flags.TypeCacheTTL),
+		}
+
+		n := fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], makeDirEntryPlus(e, entry))
+		if n == 0 {
+			// the kernel's buffer is full; undo the Ref we just took for
+			// the entry that didn't fit so refcounts stay accurate on the
+			// next call at this offset.
+			fs.mu.Lock()
+			child.DeRef(1)
+			fs.mu.Unlock()
+			break
+		}
+
+		dh.inode.logFuse("<-- ReadDirPlus", *e.Name, e.Offset)
+
+		op.BytesRead += n
+	}
+
+	return
+}
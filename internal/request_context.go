@@ -0,0 +1,92 @@
+// Copyright 2015 - 2017 Ka-Hing Cheung
+// Copyright 2015 - 2017 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/mattrbianchi/twig"
+)
+
+// requestContextKey is unexported so only this file can populate or read
+// the value stashed on ctx.
+type requestContextKey struct{}
+
+// RequestContext carries the calling process's identity for one FUSE
+// request, for audit logging and (optional) local-user permission checks.
+//
+// Only Pid is real: it comes straight off the kernel's in-header via the
+// fuseops.OpContext jacobsa/fuse already threads through ctx. The vendored
+// fuse library doesn't surface the in-header's uid/gid anywhere in the
+// fuseutil.FileSystem surface, so there's no honest way to fill in a
+// per-caller Uid/Gid here short of forking that dependency to read the raw
+// request header - this type deliberately doesn't carry fields for them.
+// See checkPermission for what that means for FlagStorage.RestrictLocalAccess.
+type RequestContext struct {
+	Pid uint32
+}
+
+// withRequestContext returns a copy of ctx carrying rc, for op dispatch to
+// call before invoking a handler.
+func (fs *Fusera) withRequestContext(ctx context.Context, rc RequestContext) context.Context {
+	return context.WithValue(ctx, requestContextKey{}, rc)
+}
+
+// RequestorFromContext returns the calling process's pid for the in-flight
+// request, as recorded by op dispatch. ok is false if ctx wasn't produced
+// by this package's dispatch path (e.g. a context from a background
+// goroutine like the refresh loop).
+func RequestorFromContext(ctx context.Context) (pid uint32, ok bool) {
+	rc, ok := ctx.Value(requestContextKey{}).(RequestContext)
+	if !ok {
+		return 0, false
+	}
+	return rc.Pid, true
+}
+
+// requestContext builds the RequestContext for the current op from the
+// OpContext jacobsa/fuse attaches to ctx.
+func (fs *Fusera) requestContext(ctx context.Context) RequestContext {
+	return RequestContext{Pid: uint32(fuseops.OpContextFromContext(ctx).Pid)}
+}
+
+// auditf writes one audit-log line recording who did what, when
+// flags.AuditLog is set. format/args follow the twig.Infof convention used
+// elsewhere in this package. It logs pid only, per the caveat on
+// RequestContext - there's no caller uid/gid to log honestly yet.
+func (fs *Fusera) auditf(ctx context.Context, accession string, format string, args ...interface{}) {
+	if !fs.flags.AuditLog {
+		return
+	}
+
+	pid, _ := RequestorFromContext(ctx)
+	msg := fmt.Sprintf(format, args...)
+	twig.Infof("audit: pid=%v accession=%v %v", pid, accession, msg)
+}
+
+// checkPermission always allows the request. FlagStorage.RestrictLocalAccess
+// would need to compare the caller's uid against the mount owner, but
+// RequestContext has no caller uid to compare (see its doc comment) - so
+// rather than silently no-op a requested security control, NewFusera
+// refuses to start at all when RestrictLocalAccess is set. This function
+// stays a trivial pass-through so call sites don't need to change if/when
+// jacobsa/fuse grows a way to read the real uid/gid.
+func (fs *Fusera) checkPermission(ctx context.Context) error {
+	return nil
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/mattrbianchi/twig"
 	"github.com/mitre/fusera/awsutil"
+	"github.com/mitre/fusera/internal/diskcache"
 	"github.com/mitre/fusera/nr"
 	"github.com/pkg/errors"
 
@@ -62,6 +63,10 @@ func Mount(ctx context.Context, flags *FlagStorage) (*Fusera, *fuse.MountedFileS
 	if err != nil {
 		return nil, nil, errors.Errorf("Mount: %v", err)
 	}
+
+	fs.setConnection(mfs)
+	go fs.refreshLoop()
+
 	return fs, mfs, nil
 }
 
@@ -76,6 +81,16 @@ func NewFusera(ctx context.Context, flags *FlagStorage) (*Fusera, error) {
 		umask: 0122,
 	}
 
+	if flags.RestrictLocalAccess {
+		// There's no way to honor this: jacobsa/fuse never surfaces the
+		// in-header's uid/gid to a fuseutil.FileSystem implementation
+		// (see RequestContext's doc comment), so checkPermission has
+		// nothing to compare the caller's identity against. Refuse to
+		// mount rather than accept the flag and silently let every local
+		// user through.
+		return nil, errors.New("--restrict-local-access is not implemented: fusera cannot determine a caller's uid from this fuse library")
+	}
+
 	// if flags.DebugS3 {
 	// 	awsConfig.LogLevel = aws.LogLevel(aws.LogDebug | aws.LogDebugWithRequestErrors)
 	// 	s3Log.Level = logrus.DebugLevel
@@ -89,6 +104,20 @@ func NewFusera(ctx context.Context, flags *FlagStorage) (*Fusera, error) {
 
 	fs.bufferPool = BufferPool{}.Init()
 
+	if flags.CacheDir != "" {
+		fs.cache, err = diskcache.Open(diskcache.Config{
+			Dir:    flags.CacheDir,
+			SizeGB: flags.CacheSizeGB,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open disk cache")
+		}
+	}
+
+	// the kernel hasn't sent FUSE_INIT yet at this point, so max_readahead
+	// isn't known; Fusera.Init fills in the negotiated value once it is.
+	fs.readahead = NewReadahead(flags, 0, fetchRangeForReadahead)
+
 	fs.nextInodeID = fuseops.RootInodeID + 1
 	fs.inodes = make(map[fuseops.InodeID]*Inode)
 	root := NewInode(fs, nil, awsutil.String(""), awsutil.String(""))
@@ -183,6 +212,15 @@ type Fusera struct {
 
 	bufferPool *BufferPool
 
+	// cache is the on-disk block cache consulted before issuing an HTTP
+	// Range GET in ReadFile. nil when flags.CacheDir is unset.
+	cache *diskcache.Cache
+
+	// readahead speculatively prefetches the next chunk of a file when
+	// ReadFile sees sequential access. Always set by NewFusera; Init
+	// clamps its fetch size to the negotiated max_readahead.
+	readahead *Readahead
+
 	// A lock protecting the state of the file system struct itself (distinct
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
 	mu sync.Mutex
@@ -214,6 +252,12 @@ type Fusera struct {
 	// restorers   *Ticket
 
 	forgotCnt uint32
+
+	// conn is the live fuse connection, set by Mount once it has mounted
+	// the filesystem. Used to send FUSE_NOTIFY_INVAL_INODE/ENTRY frames.
+	//
+	// GUARDED_BY(mu)
+	conn *fuse.Connection
 }
 
 func (fs *Fusera) allocateInodeId() (id fuseops.InodeID) {
@@ -263,6 +307,11 @@ func (fs *Fusera) StatFS(ctx context.Context, op *fuseops.StatFSOp) (err error)
 func (fs *Fusera) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) (err error) {
 	//fmt.Println("sddp.go/GetInodeAttributes called")
 
+	ctx = fs.withRequestContext(ctx, fs.requestContext(ctx))
+	if err = fs.checkPermission(ctx); err != nil {
+		return
+	}
+
 	fs.mu.Lock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.Unlock()
@@ -276,15 +325,25 @@ func (fs *Fusera) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAt
 	return
 }
 
+// cachedBytesXattr is a synthetic, read-only xattr reporting how many bytes
+// of a file's contents currently live in fs.cache. It isn't stored on the
+// inode itself since it reflects fs-wide cache state, not the file.
+const cachedBytesXattr = "user.fusera.cached_bytes"
+
 func (fs *Fusera) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) (err error) {
 	//fmt.Println("sddp.go/GetXattr called")
 	fs.mu.Lock()
 	inode := fs.getInodeOrDie(op.Inode)
 	fs.mu.Unlock()
 
-	value, err := inode.GetXattr(op.Name)
-	if err != nil {
-		return
+	var value []byte
+	if op.Name == cachedBytesXattr && fs.cache != nil {
+		value = []byte(strconv.FormatInt(fs.cache.CachedBytes(inode.Link), 10))
+	} else {
+		value, err = inode.GetXattr(op.Name)
+		if err != nil {
+			return
+		}
 	}
 
 	op.BytesRead = len(value)
@@ -304,6 +363,9 @@ func (fs *Fusera) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) (err e
 	fs.mu.Unlock()
 
 	xattrs, err := inode.ListXattr()
+	if fs.cache != nil && inode.dir == nil {
+		xattrs = append(xattrs, cachedBytesXattr)
+	}
 
 	ncopied := 0
 
@@ -336,6 +398,11 @@ func (fs *Fusera) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) (e
 	var ok bool
 	defer func() { fuseLog.Debugf("<-- LookUpInode %v %v %v", op.Parent, op.Name, err) }()
 
+	ctx = fs.withRequestContext(ctx, fs.requestContext(ctx))
+	if err = fs.checkPermission(ctx); err != nil {
+		return
+	}
+
 	fs.mu.Lock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.Unlock()
@@ -528,6 +595,12 @@ func (fs *Fusera) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHa
 
 func (fs *Fusera) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err error) {
 	//fmt.Println("sddp.go/OpenFile called")
+
+	ctx = fs.withRequestContext(ctx, fs.requestContext(ctx))
+	if err = fs.checkPermission(ctx); err != nil {
+		return
+	}
+
 	fs.mu.Lock()
 	in := fs.getInodeOrDie(op.Inode)
 	fs.mu.Unlock()
@@ -537,6 +610,8 @@ func (fs *Fusera) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err err
 		return
 	}
 
+	fs.auditf(ctx, *in.FullName(), "opened")
+
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
@@ -551,17 +626,7 @@ func (fs *Fusera) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err err
 	return
 }
 
-func (fs *Fusera) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err error) {
-	//fmt.Println("sddp.go/ReadFile called")
-
-	fs.mu.Lock()
-	fh := fs.fileHandles[op.Handle]
-	fs.mu.Unlock()
-
-	op.BytesRead, err = fh.ReadFile(op.Offset, op.Dst)
-
-	return
-}
+// ReadFile is implemented in read_file.go.
 
 func (fs *Fusera) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) (err error) {
 
@@ -578,6 +643,10 @@ func (fs *Fusera) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFile
 	fh := fs.fileHandles[op.Handle]
 	fh.Release()
 
+	if fs.readahead != nil {
+		fs.readahead.Cancel(op.Handle)
+	}
+
 	fuseLog.Debugln("ReleaseFileHandle", *fh.inode.FullName())
 
 	delete(fs.fileHandles, op.Handle)